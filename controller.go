@@ -18,10 +18,15 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -32,12 +37,47 @@ import (
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/util/intstr"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 var (
 	resyncPeriod = 30 * time.Second
+
+	syncWorkers = flag.Int("sync-workers", 1,
+		"Number of concurrent worker goroutines to run per TaskQueue. Increase on clusters "+
+			"with large numbers of services/endpoints to avoid serializing NGINX config generation.")
+
+	// reconcileDelay is how long reconcileOrphanConfigs waits, once runLeader
+	// has started it, before the first orphan config sweep, giving the
+	// initial cache sync time to complete.
+	reconcileDelay = 5 * time.Minute
+	// reconcilePeriod is the interval between subsequent orphan config sweeps.
+	reconcilePeriod = 5 * time.Minute
+
+	endpointWaitTimeout = flag.Duration("endpoint-wait-timeout", 30*time.Second,
+		"Max time to wait at startup for each lbex-managed service to report at least one ready "+
+			"endpoint before the services queue workers start. Zero disables the wait.")
+
+	leaderElect = flag.Bool("leader-elect", false,
+		"Enable leader election so that only one lbex replica writes NGINX config and reloads at a time.")
+	leaderElectionNamespace = flag.String("leader-elect-namespace", "kube-system",
+		"Namespace holding the leader election lock when --leader-elect is set.")
 )
 
+const leaderElectionLockName = "lbex-leader"
+
+// defaultClientIPAffinityTimeoutSeconds matches Kubernetes' own default for
+// spec.sessionAffinityConfig.clientIP.timeoutSeconds, used when the field is
+// left unset so lbex's stickiness window agrees with in-cluster kube-proxy.
+const defaultClientIPAffinityTimeoutSeconds = 10800
+
+// clientIPAffinityAlgorithm is the nginx stream module's consistent-hash-by
+// -client-IP balancing method, used in place of the annotated algorithm for
+// services with sessionAffinity=ClientIP. Unlike the http upstream module's
+// "ip_hash", this is the form the stream module actually accepts.
+const clientIPAffinityAlgorithm = "hash $remote_addr consistent"
+
 // List Watch (lw) Controller (lwc)
 type lwController struct {
 	controller *cache.Controller
@@ -66,6 +106,11 @@ type lbExController struct {
 	stopCh chan struct{}
 
 	cfgtor *nginx.Configurator
+
+	// leaderMu guards leaderID, the identity of the pod currently acting as
+	// leader, exposed on the status/healthz endpoint.
+	leaderMu sync.RWMutex
+	leaderID string
 }
 
 func newLbExController(clientset *kubernetes.Clientset, service *string) *lbExController {
@@ -88,29 +133,339 @@ func newLbExController(clientset *kubernetes.Clientset, service *string) *lbExCo
 		service:   *service,
 		cfgtor:    configtor,
 	}
-	lbexc.nodesQueue = NewTaskQueue(lbexc.syncNodes)
+	lbexc.nodesQueue = NewTaskQueue(func(obj interface{}) error {
+		return lbexc.safeSync("nodes", lbexc.nodesQueue, lbexc.syncNodes, obj)
+	})
 	lbexc.nodesLWC = newNodesListWatchControllerForClientset(&lbexc)
-	lbexc.servicesQueue = NewTaskQueue(lbexc.syncServices)
+	lbexc.servicesQueue = NewTaskQueue(func(obj interface{}) error {
+		return lbexc.safeSync("services", lbexc.servicesQueue, lbexc.syncServices, obj)
+	})
 	lbexc.servciesLWC = newServicesListWatchControllerForClientset(&lbexc)
-	lbexc.endpointsQueue = NewTaskQueue(lbexc.syncEndpoints)
+	lbexc.endpointsQueue = NewTaskQueue(func(obj interface{}) error {
+		return lbexc.safeSync("endpoints", lbexc.endpointsQueue, lbexc.syncEndpoints, obj)
+	})
 	lbexc.endpointsLWC = newEndpointsListWatchControllerForClientset(&lbexc)
 
 	return &lbexc
 }
 
+// run starts the controller, either directly or, when --leader-elect is set,
+// only once this process has acquired the leader lock. Followers keep their
+// informers/queues idle and take over as soon as the leader steps down or
+// its lease expires.
 func (lbex *lbExController) run() {
+	if !*leaderElect {
+		lbex.setLeader(lbex.identity())
+		lbex.runLeader(lbex.stopCh)
+		return
+	}
+	lbex.runWithLeaderElection()
+}
+
+// runLeader starts the informer/queue goroutines that actually talk to
+// NGINX, stopping them when stopCh closes. Only the elected leader (or every
+// replica, when leader election is disabled) should ever call this. With
+// leader election on, stopCh is scoped to a single leadership term -- not
+// lbex.stopCh -- so a lost/reacquired lease starts and stops these goroutines
+// in-process instead of tearing down the whole process.
+func (lbex *lbExController) runLeader(stopCh <-chan struct{}) {
 	// run the controller and queue goroutines
-	go lbex.nodesLWC.controller.Run(lbex.stopCh)
-	go lbex.nodesQueue.Run(time.Second, lbex.stopCh)
+	go lbex.nodesLWC.controller.Run(stopCh)
+	lbex.runWorkers("nodes", lbex.nodesQueue, stopCh)
 
-	go lbex.endpointsLWC.controller.Run(lbex.stopCh)
-	go lbex.endpointsQueue.Run(time.Second, lbex.stopCh)
+	go lbex.endpointsLWC.controller.Run(stopCh)
+	lbex.runWorkers("endpoints", lbex.endpointsQueue, stopCh)
 
 	// Allow time for the initial cache update for all nodes and endpoints to take place 1st
 	time.Sleep(5 * time.Second)
-	go lbex.servciesLWC.controller.Run(lbex.stopCh)
-	go lbex.servicesQueue.Run(time.Second, lbex.stopCh)
 
+	// Start the services informer (so servicesStore is populated) but hold
+	// off on processing the services queue until every managed service has
+	// a ready endpoint: waitForEndpoints reads servicesStore, so it's a
+	// no-op unless the cache has actually synced first.
+	go lbex.servciesLWC.controller.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, lbex.servciesLWC.controller.HasSynced) {
+		glog.Warningf("runLeader: stopped before services cache synced")
+		return
+	}
+	lbex.waitForEndpoints()
+	lbex.runWorkers("services", lbex.servicesQueue, stopCh)
+
+	go lbex.reconcileOrphanConfigs(stopCh)
+}
+
+// runWithLeaderElection blocks running the leader election loop: it starts
+// runLeader() while this process holds the lock and relies on the
+// leaderelection package to close the per-term stop channel it hands to
+// OnStartedLeading as soon as the lease is lost, so a follower stands by
+// ready to take over in-process rather than exiting.
+func (lbex *lbExController) runWithLeaderElection() {
+	id := lbex.identity()
+
+	lock, err := resourcelock.New(
+		resourcelock.ConfigMapsResourceLock,
+		*leaderElectionNamespace,
+		leaderElectionLockName,
+		lbex.clientset.Core(),
+		resourcelock.ResourceLockConfig{Identity: id},
+	)
+	if err != nil {
+		glog.Fatalf("runWithLeaderElection: unable to create leader election lock: %v", err)
+	}
+
+	leaderelection.RunOrDie(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(stop <-chan struct{}) {
+				glog.V(2).Infof("runWithLeaderElection: %s elected leader, starting controllers", id)
+				lbex.setLeader(id)
+				lbex.runLeader(stop)
+			},
+			OnStoppedLeading: func() {
+				glog.Warningf("runWithLeaderElection: %s lost leadership, standing by as a follower", id)
+				lbex.setLeader("")
+			},
+			OnNewLeader: func(identity string) {
+				lbex.setLeader(identity)
+				if identity != id {
+					glog.V(2).Infof("runWithLeaderElection: new leader elected: %s", identity)
+				}
+			},
+		},
+	})
+}
+
+// identity returns the value this process advertises to the leader election
+// lock and exposes via Leader(); it defaults to the pod's hostname.
+func (lbex *lbExController) identity() string {
+	host, err := os.Hostname()
+	if err != nil {
+		glog.Warningf("identity: failed to read hostname, falling back to \"unknown\": %v", err)
+		return "unknown"
+	}
+	return host
+}
+
+// setLeader records id as the currently active leader.
+func (lbex *lbExController) setLeader(id string) {
+	lbex.leaderMu.Lock()
+	lbex.leaderID = id
+	lbex.leaderMu.Unlock()
+}
+
+// Leader returns the identity of the lbex replica currently acting as
+// leader, for the status/healthz endpoint to report to operators.
+func (lbex *lbExController) Leader() string {
+	lbex.leaderMu.RLock()
+	defer lbex.leaderMu.RUnlock()
+	return lbex.leaderID
+}
+
+// ServeHTTP implements the status/healthz endpoint so operators can see
+// which replica is currently acting as leader, e.g.
+// http.Handle("/healthz", lbexc) alongside lbex's other status checks.
+func (lbex *lbExController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	leader := lbex.Leader()
+	if leader == "" {
+		fmt.Fprintln(w, "ok\nleader: unknown")
+		return
+	}
+	fmt.Fprintf(w, "ok\nleader: %s\n", leader)
+}
+
+// waitForEndpoints holds back the start of the services queue workers until
+// every lbex-managed service in the cache has at least one ready endpoint, or
+// *endpointWaitTimeout elapses, whichever comes first. The services informer
+// is already running by then, since servicesStore is what this reads; only
+// the processing of service keys waits. This mirrors the wait
+// pattern used in k8s e2e's endpoints framework and avoids a thundering herd
+// of config regenerations against services whose pods are still starting.
+func (lbex *lbExController) waitForEndpoints() {
+	if *endpointWaitTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(*endpointWaitTimeout)
+	for {
+		if lbex.allManagedServicesHaveEndpoints() {
+			return
+		}
+		if time.Now().After(deadline) {
+			glog.Warningf("waitForEndpoints: timed out after %v waiting for managed services to have ready endpoints", *endpointWaitTimeout)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// allManagedServicesHaveEndpoints reports whether every service currently in
+// servicesStore that lbex would manage has at least one ready endpoint.
+func (lbex *lbExController) allManagedServicesHaveEndpoints() bool {
+	for _, obj := range lbex.servicesStore.List() {
+		if !ValidateServiceObject(obj) {
+			continue
+		}
+		service, ok := obj.(*v1.Service)
+		if !ok {
+			continue
+		}
+		if lbex.service != "" && lbex.service != service.Name {
+			continue
+		}
+		hasEndpoint := false
+		for _, servicePort := range service.Spec.Ports {
+			if lbex.hasReadyEndpoint(service, &servicePort) {
+				hasEndpoint = true
+				break
+			}
+		}
+		if !hasEndpoint {
+			return false
+		}
+	}
+	return true
+}
+
+// hasReadyEndpoint reports whether the Endpoints object backing service has
+// at least one ready address for servicePort. It deliberately doesn't go
+// through getEndpoints: that also synthesizes always-present NodePort
+// entries for externalTrafficPolicy=Local and not-ready "backup" addresses
+// for the include-not-ready annotation, either of which would report a
+// service as having endpoints when it has zero ready pods.
+func (lbex *lbExController) hasReadyEndpoint(service *v1.Service, servicePort *v1.ServicePort) bool {
+	svcEndpoints, err := lbex.getServiceEndpoints(service)
+	if err != nil {
+		return false
+	}
+	for _, subset := range svcEndpoints.Subsets {
+		if len(subset.Addresses) == 0 {
+			continue
+		}
+		for _, epPort := range subset.Ports {
+			switch servicePort.TargetPort.Type {
+			case intstr.Int:
+				servicePortInt, err := GetServicePortTargetPortInt(servicePort)
+				if err != nil {
+					continue
+				}
+				if epPort.Port == int32(servicePortInt) {
+					return true
+				}
+			case intstr.String:
+				if epPort.Name == servicePort.TargetPort.StrVal {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// runWorkers starts *syncWorkers goroutines pulling from queue, stopping
+// when stopCh closes. Panics while processing an individual key are
+// recovered by safeSync, which re-enqueues the key rather than crashing a
+// worker, so no extra recovery is needed here.
+func (lbex *lbExController) runWorkers(name string, queue *TaskQueue, stopCh <-chan struct{}) {
+	workers := *syncWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go queue.Run(time.Second, stopCh)
+	}
+}
+
+// safeSync wraps a TaskQueue sync function with HandleCrash-style panic
+// recovery scoped to the single key being processed: a panic logs its stack
+// and re-enqueues the key for another attempt, rather than crashing the
+// worker or leaving the key stuck "in-flight" in the underlying workqueue
+// (which a panic escaping mid-call would, since Done/Forget never run).
+func (lbex *lbExController) safeSync(name string, queue *TaskQueue, syncFn func(interface{}) error, obj interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("recovered from panic in %s sync of key %v: %v\n%s", name, obj, r, debug.Stack())
+			if key, ok := obj.(string); ok {
+				queue.Enqueue(key)
+			}
+			err = nil
+		}
+	}()
+	return syncFn(obj)
+}
+
+// reconcileOrphanConfigs periodically lists the NGINX configs lbex has
+// written to disk and enqueues any that no longer correspond to a Service in
+// servicesStore, so orphaned config files get cleaned up even if a delete
+// event was dropped or missed while the controller was down. It stops when
+// stopCh closes, e.g. at the end of a leadership term.
+func (lbex *lbExController) reconcileOrphanConfigs(stopCh <-chan struct{}) {
+	select {
+	case <-time.After(reconcileDelay):
+	case <-stopCh:
+		return
+	}
+	ticker := time.NewTicker(reconcilePeriod)
+	defer ticker.Stop()
+	for {
+		lbex.reconcileOnce()
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// reconcileOnce performs a single orphan-config sweep. It reconciles against
+// the Configurator's persisted key->filename index rather than trying to
+// reverse the filename back into a key: namespaces and service names may
+// themselves contain hyphens, so blindly swapping a hyphen for a slash (e.g.
+// "kube-system-dns" -> "kube/system-dns") can land on a key that doesn't
+// exist and get a live config deleted.
+func (lbex *lbExController) reconcileOnce() {
+	filenames, err := lbex.cfgtor.ListConfigurations()
+	if err != nil {
+		glog.V(2).Infof("reconcileOnce: failed to list NGINX configs: %v", err)
+		return
+	}
+
+	// FilenameIndex is backed by the Configurator's own persisted record of
+	// what it wrote, so it's complete even across an lbex restart -- unlike
+	// a map kept only in this process's memory, it still knows about shared
+	// group-*.conf files and which keys own a stanza in them.
+	keysByFilename := make(map[string][]string)
+	for key, filename := range lbex.cfgtor.FilenameIndex() {
+		keysByFilename[filename] = append(keysByFilename[filename], key)
+	}
+
+	for _, filename := range filenames {
+		keys, known := keysByFilename[filename]
+		if !known {
+			// The Configurator has no record of ever writing this file
+			// (e.g. lbex did not write it), so there's no reliable way to recover the
+			// owning key from the filename alone. Leave it alone rather
+			// than guess.
+			glog.V(3).Infof("reconcileOnce: config %s has no known owning key, skipping", filename)
+			continue
+		}
+		orphaned := true
+		for _, key := range keys {
+			if _, exists, err := lbex.servicesStore.GetByKey(key); err == nil && exists {
+				orphaned = false
+				break
+			}
+		}
+		if orphaned {
+			for _, key := range keys {
+				glog.V(2).Infof("reconcileOnce: found orphaned config %s, enqueuing %s for cleanup", filename, key)
+				lbex.servicesQueue.Enqueue(key)
+			}
+		}
+	}
 }
 
 func (lbex *lbExController) syncNodes(obj interface{}) error {
@@ -169,16 +524,15 @@ func (lbex *lbExController) syncServices(obj interface{}) error {
 	if !ok {
 		return errors.New("syncServices: type assertion faild for key string")
 	}
-	// some-namespace/some-service -> some-namespace-some-service
-	filename := strings.Replace(key, "/", "-", -1)
 
 	storeObj, exists, err := lbex.servicesStore.GetByKey(key)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		glog.V(2).Infof("syncServices: deleting service: %v\n", key)
-		lbex.cfgtor.DeleteConfiguration(filename, nginx.StreamCfg)
+		filename := lbex.forgetConfigFilename(key)
+		glog.V(2).Infof("syncServices: deleting service: %v, from config: %s\n", key, filename)
+		lbex.cfgtor.DeleteConfiguration(filename, key, nginx.StreamCfg)
 	} else {
 		err = ValidateServiceObjectType(storeObj)
 		if err != nil {
@@ -191,16 +545,66 @@ func (lbex *lbExController) syncServices(obj interface{}) error {
 			glog.V(4).Infof("syncServices: %s: not an lbex manage service", key)
 			return nil
 		}
+		filename := lbex.configFilename(key, storeObj.(*v1.Service))
 		svcSpec := &nginx.ServiceSpec{
 			Key:     key,
 			Service: storeObj.(*v1.Service),
 		}
-		glog.V(3).Infof("syncServices: add/update service: %s,\n%v", key, svcSpec)
+		glog.V(3).Infof("syncServices: add/update service: %s, config: %s,\n%v", key, filename, svcSpec)
 		lbex.cfgtor.AddOrUpdateService(filename, svcSpec)
 	}
 	return nil
 }
 
+// configFilename returns the config file a service's stanza belongs in.
+// Services sharing an explicit serviceloadbalancer/group annotation, or the
+// same (host, frontend port) pair, are grouped into a single file containing
+// one server {} block with a location/upstream stanza per member so they can
+// share a listener. Ungrouped services keep the legacy one-file-per-service
+// behavior, keyed by "namespace-service".
+func (lbex *lbExController) configFilename(key string, service *v1.Service) string {
+	var filename string
+	if group, ok := annotations.GetGroup(service); ok && group != "" {
+		filename = "group-" + strings.Replace(group, "/", "-", -1)
+	} else if host, ok := annotations.GetHost(service); ok && host != "" {
+		filename = fmt.Sprintf("group-%s-%d", strings.Replace(host, ".", "-", -1), servicePrimaryFrontendPort(service))
+	} else {
+		// some-namespace/some-service -> some-namespace-some-service
+		filename = strings.Replace(key, "/", "-", -1)
+	}
+	// Recorded through the Configurator (which persists it alongside the
+	// config files it writes) rather than kept only in our own memory, so
+	// the mapping survives an lbex restart -- a grouped service's filename
+	// can't be recovered from its key alone once the annotations that chose
+	// it are gone from servicesStore.
+	lbex.cfgtor.RecordFilename(key, filename)
+	return filename
+}
+
+// forgetConfigFilename removes and returns the config filename previously
+// recorded for key, falling back to the legacy per-service filename if none
+// was recorded (e.g. it was never synced in this Configurator's lifetime).
+func (lbex *lbExController) forgetConfigFilename(key string) string {
+	filename, ok := lbex.cfgtor.ForgetFilename(key)
+	if !ok {
+		filename = strings.Replace(key, "/", "-", -1)
+	}
+	return filename
+}
+
+// servicePrimaryFrontendPort returns the port of the service's first
+// declared ServicePort, used to key the shared config file for host-based
+// grouping when no explicit serviceloadbalancer/group annotation is set.
+func servicePrimaryFrontendPort(service *v1.Service) int {
+	if len(service.Spec.Ports) == 0 {
+		return 0
+	}
+	return int(service.Spec.Ports[0].Port)
+}
+
+// syncEndpoints is the fast path for rolling deploys: rather than
+// regenerating the full server config (syncServices), it rewrites just the
+// upstream {} block for the parent service's config file and reloads NGINX.
 func (lbex *lbExController) syncEndpoints(obj interface{}) error {
 	if lbex.endpointsQueue.IsShuttingDown() {
 		return nil
@@ -211,22 +615,45 @@ func (lbex *lbExController) syncEndpoints(obj interface{}) error {
 		return errors.New("syncEndpoints: key string type assertion failed")
 	}
 
-	_, exists, err := lbex.endpointStore.GetByKey(key)
+	storeObj, exists, err := lbex.servicesStore.GetByKey(key)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		glog.V(2).Infof("syncEndpoints: deleting removed endpoint: %v\n", key)
-		// TODO, need a service object here...
-		// lbex.cfgtor.UpdateServiceEndpoints(key, <future thing>)
-	} else {
-		tcpSvc, udpSvc := lbex.getService(key)
-		if len(udpSvc) == 0 && len(tcpSvc) == 0 {
-			glog.V(4).Info("syncEndpoints: not a lbex managed service endpoint")
-		} else {
-			glog.V(3).Infof("syncEndpoints: add/update lbex managed service: %s, with endpoints:\nTCP Services: %v\nUDP Services: %v", key, tcpSvc, udpSvc)
-		}
+		glog.V(4).Infof("syncEndpoints: %s: no parent service in cache, nothing to do", key)
+		return nil
 	}
+
+	// getService can't distinguish "managed but endpoints just disappeared"
+	// from "not a lbex-managed service" -- both yield empty tcp/udp lists --
+	// so check that ourselves before deciding whether a missing Endpoints
+	// object means "clear this upstream" or "nothing to do".
+	if !ValidateServiceObject(storeObj) {
+		glog.V(4).Info("syncEndpoints: not a lbex managed service endpoint")
+		return nil
+	}
+
+	// Check whether the endpoints disappeared *before* asking getService for
+	// the current server list: once the last endpoint is gone, getService
+	// itself returns empty tcpSvc/udpSvc (it skips any port with zero
+	// endpoints), so gating on "not managed" first made the clear-upstream
+	// branch below unreachable and left stale servers in the config.
+	_, endpointsExist, err := lbex.endpointStore.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	tcpSvc, udpSvc := lbex.getService(key)
+	if !endpointsExist {
+		glog.V(2).Infof("syncEndpoints: endpoints removed for service: %v, clearing upstream\n", key)
+	} else if len(udpSvc) == 0 && len(tcpSvc) == 0 {
+		glog.V(4).Info("syncEndpoints: not a lbex managed service endpoint")
+		return nil
+	}
+	filename := lbex.configFilename(key, storeObj.(*v1.Service))
+
+	glog.V(3).Infof("syncEndpoints: rewriting upstream for service: %s, config: %s,\nTCP Services: %v\nUDP Services: %v", key, filename, tcpSvc, udpSvc)
+	lbex.cfgtor.UpdateServiceEndpoints(filename, key, tcpSvc, udpSvc)
 	return nil
 }
 
@@ -244,11 +671,25 @@ func (lbex *lbExController) getServiceEndpoints(service *v1.Service) (endpoints
 
 // getEndpoints returns a list of <endpoint ip>:<port> for a given service/target port combination.
 func (lbex *lbExController) getEndpoints(service *v1.Service, servicePort *v1.ServicePort) (endpoints []string) {
+	if service.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		return lbex.getLocalNodeEndpoints(service, servicePort)
+	}
+
 	svcEndpoints, err := lbex.getServiceEndpoints(service)
 	if err != nil {
 		return
 	}
 
+	// By default not-ready addresses (failing readiness probes) are strictly
+	// excluded, matching kube-proxy. Services opting in via the
+	// serviceloadbalancer/l7.include-not-ready annotation get them added as
+	// NGINX "backup" servers so they only take traffic once every ready
+	// endpoint has failed.
+	includeNotReady := false
+	if val, ok := annotations.GetIncludeNotReady(service); ok {
+		includeNotReady = val
+	}
+
 	// The intent here is to create a union of all subsets that match a targetPort.
 	// We know the endpoint already matches the service, so all pod ips that have
 	// the target port are capable of service traffic for it.
@@ -278,11 +719,52 @@ func (lbex *lbExController) getEndpoints(service *v1.Service, servicePort *v1.Se
 			for _, epAddress := range subsets.Addresses {
 				endpoints = append(endpoints, fmt.Sprintf("%v:%v", epAddress.IP, targetPort))
 			}
+
+			// nginx rejects a stream upstream that mixes a "hash" balancing
+			// method with "backup" servers, so a ClientIP-affinity service
+			// can't also carry the not-ready addresses getService would
+			// otherwise turn into hash's invalid "backup" entries.
+			if includeNotReady && service.Spec.SessionAffinity != v1.ServiceAffinityClientIP {
+				for _, epAddress := range subsets.NotReadyAddresses {
+					glog.V(4).Infof("getEndpoints: %s: including not-ready endpoint %s as backup", service.Name, epAddress.IP)
+					endpoints = append(endpoints, fmt.Sprintf("%v:%v backup", epAddress.IP, targetPort))
+				}
+			}
 		}
 	}
 	return
 }
 
+// getLocalNodeEndpoints builds the upstream server list for a Service with
+// externalTrafficPolicy=Local. kube-proxy only forwards such traffic to pods
+// on the node that received it, so instead of pod IPs we list the service's
+// NodePort on every node the Configurator knows about, preserving client
+// source IP per the semantics in Kubernetes' service REST layer.
+//
+// Whether a node actually has a healthy local endpoint for this service is a
+// live, per-service signal -- that's what HealthCheckNodePort is for, and
+// it's set on newSvc.HealthCheckPort in getService so the NGINX template can
+// emit a "health_check" directive and let nginx itself probe it and mark
+// servers down dynamically. The "down" we emit here instead reflects the
+// node's own control-plane Active/schedulable state, a signal lbex already
+// tracks (see syncNodes) and one the stream health_check can't see (a
+// cordoned node still answers HealthCheckNodePort).
+func (lbex *lbExController) getLocalNodeEndpoints(service *v1.Service, servicePort *v1.ServicePort) (endpoints []string) {
+	if servicePort.NodePort == 0 {
+		glog.V(3).Infof("getLocalNodeEndpoints: %s: externalTrafficPolicy=Local but port %s has no NodePort", service.Name, servicePort.Name)
+		return nil
+	}
+
+	for _, node := range lbex.cfgtor.Nodes() {
+		entry := fmt.Sprintf("%s:%d", node.InternalIP, servicePort.NodePort)
+		if !node.Active {
+			entry += " down"
+		}
+		endpoints = append(endpoints, entry)
+	}
+	return endpoints
+}
+
 // getServices returns a list of TCP and UDP services
 func (lbex *lbExController) getServices() (tcpServices []Service, udpServices []Service) {
 	objects := lbex.servicesStore.List()
@@ -362,6 +844,28 @@ func (lbex *lbExController) getService(key string) (tcpServices []Service, udpSe
 		} else {
 			newSvc.Algorithm = nginx.DefaultAlgorithm
 		}
+
+		if service.Spec.SessionAffinity == v1.ServiceAffinityClientIP {
+			if newSvc.Algorithm != nginx.DefaultAlgorithm {
+				glog.Warningf("getService: %s: sessionAffinity=ClientIP overrides annotated algorithm %q with %q", service.Name, newSvc.Algorithm, clientIPAffinityAlgorithm)
+			}
+			// lbex proxies at L4 (nginx stream module), where "ip_hash" isn't
+			// a valid balancing method -- that's http-only. The stream
+			// equivalent for client-IP stickiness is "hash $remote_addr
+			// consistent;".
+			newSvc.Algorithm = clientIPAffinityAlgorithm
+			newSvc.AffinityTimeout = defaultClientIPAffinityTimeoutSeconds
+			if cfg := service.Spec.SessionAffinityConfig; cfg != nil && cfg.ClientIP != nil && cfg.ClientIP.TimeoutSeconds != nil {
+				newSvc.AffinityTimeout = int(*cfg.ClientIP.TimeoutSeconds)
+			}
+		}
+
+		if service.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+			// Lets the NGINX template emit a "health_check" directive so
+			// nginx itself probes kube-proxy's per-node local-endpoint
+			// count and marks a node down dynamically, without a reload.
+			newSvc.HealthCheckPort = int(service.Spec.HealthCheckNodePort)
+		}
 		newSvc.FrontendPort = int(servicePort.Port)
 
 		if servicePort.Protocol == v1.ProtocolUDP {